@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"context"
+
+	"istio.io/istio/pkg/test/framework/components/environment/kube"
+	"istio.io/istio/pkg/test/framework/resource"
+
+	cloudtracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
+	loggingpb "google.golang.org/genproto/googleapis/logging/v2"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Config defines the configuration for a fake Stackdriver deployment.
+type Config struct {
+	// Cluster to deploy to. If set, Stackdriver is deployed only to this cluster,
+	// regardless of PerCluster.
+	Cluster kube.Cluster
+
+	// PerCluster, if true, deploys a separate fake Stackdriver to every cluster in
+	// the environment instead of a single instance, so that each cluster's proxies
+	// can be verified independently. Defaults to false for backward compatibility
+	// with single-cluster environments.
+	PerCluster bool
+}
+
+// Instance represents a deployed fake Stackdriver instance, potentially spanning
+// multiple clusters.
+type Instance interface {
+	resource.Resource
+
+	// ListTimeSeries, ListLogEntries, and ListTraceSpans target the given cluster.
+	// cluster may be nil if Stackdriver was deployed to a single cluster.
+	ListTimeSeries(cluster kube.Cluster) ([]*monitoringpb.TimeSeries, error)
+	ListLogEntries(cluster kube.Cluster) ([]*loggingpb.LogEntry, error)
+	ListTraceSpans(cluster kube.Cluster) ([]*cloudtracepb.Span, error)
+
+	// ListTimeSeriesAll aggregates ListTimeSeries across every deployed cluster,
+	// annotating each result with its source cluster.
+	ListTimeSeriesAll() ([]TimeSeriesFromCluster, error)
+
+	WaitForTimeSeries(ctx context.Context, cluster kube.Cluster, matcher func(*monitoringpb.TimeSeries) bool, opts ...WaitOption) ([]*monitoringpb.TimeSeries, error)
+	WaitForLogEntries(ctx context.Context, cluster kube.Cluster, matcher func(*loggingpb.LogEntry) bool, opts ...WaitOption) ([]*loggingpb.LogEntry, error)
+
+	// Reset clears the accumulated time series, log entries, and trace spans on
+	// every deployed cluster, so that subtests can share a single Instance without
+	// leaking state between them.
+	Reset() error
+	// Snapshot captures the current state of every deployed cluster, to be restored
+	// later via Restore.
+	Snapshot() (State, error)
+	// Restore replaces the current state of every deployed cluster with a State
+	// previously captured by Snapshot.
+	Restore(State) error
+
+	GetStackdriverNamespace(cluster kube.Cluster) string
+}
+
+// New returns a new instance of fake Stackdriver.
+func New(ctx resource.Context, cfg Config) (Instance, error) {
+	return newKube(ctx, cfg)
+}
@@ -15,10 +15,16 @@
 package stackdriver
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	environ "istio.io/istio/pkg/test/env"
@@ -29,6 +35,7 @@ import (
 	"istio.io/istio/pkg/test/scopes"
 
 	jsonpb "github.com/golang/protobuf/jsonpb"
+	cloudtracepb "google.golang.org/genproto/googleapis/devtools/cloudtrace/v2"
 	ltype "google.golang.org/genproto/googleapis/logging/type"
 	loggingpb "google.golang.org/genproto/googleapis/logging/v2"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
@@ -37,6 +44,9 @@ import (
 const (
 	stackdriverNamespace = "istio-stackdriver"
 	stackdriverPort      = 8091
+
+	defaultWaitTimeout      = 30 * time.Second
+	defaultWaitPollInterval = 500 * time.Millisecond
 )
 
 var (
@@ -44,18 +54,32 @@ var (
 	_ io.Closer = &kubeComponent{}
 )
 
-type kubeComponent struct {
-	id        resource.ID
+// clusterComponent is the per-cluster deployment of the Stackdriver mock.
+type clusterComponent struct {
 	ns        namespace.Instance
 	forwarder testKube.PortForwarder
 	cluster   kube.Cluster
 }
 
+type kubeComponent struct {
+	id       resource.ID
+	ctx      resource.Context
+	clusters map[kube.Cluster]*clusterComponent
+	dumpOnce sync.Once
+}
+
 func newKube(ctx resource.Context, cfg Config) (Instance, error) {
 	c := &kubeComponent{
-		cluster: kube.ClusterOrDefault(cfg.Cluster, ctx.Environment()),
+		ctx:      ctx,
+		clusters: map[kube.Cluster]*clusterComponent{},
 	}
 	c.id = ctx.TrackResource(c)
+
+	clusters := []kube.Cluster{kube.ClusterOrDefault(cfg.Cluster, ctx.Environment())}
+	if cfg.PerCluster && cfg.Cluster == nil {
+		clusters = ctx.Environment().(kube.Environment).Clusters()
+	}
+
 	var err error
 	scopes.CI.Info("=== BEGIN: Deploy Stackdriver ===")
 	defer func() {
@@ -68,7 +92,20 @@ func newKube(ctx resource.Context, cfg Config) (Instance, error) {
 		}
 	}()
 
-	c.ns, err = namespace.New(ctx, namespace.Config{
+	for _, cluster := range clusters {
+		cc, cerr := deployStackdriver(ctx, cluster)
+		if cerr != nil {
+			err = cerr
+			return nil, err
+		}
+		c.clusters[cluster] = cc
+	}
+
+	return c, nil
+}
+
+func deployStackdriver(ctx resource.Context, cluster kube.Cluster) (*clusterComponent, error) {
+	ns, err := namespace.New(ctx, namespace.Config{
 		Prefix: stackdriverNamespace,
 	})
 	if err != nil {
@@ -81,18 +118,18 @@ func newKube(ctx resource.Context, cfg Config) (Instance, error) {
 		return nil, fmt.Errorf("failed to read %s, err: %v", environ.StackdriverInstallFilePath, err)
 	}
 
-	if _, err := c.cluster.ApplyContents(c.ns.Name(), string(yamlContent)); err != nil {
+	if _, err := cluster.ApplyContents(ns.Name(), string(yamlContent)); err != nil {
 		return nil, fmt.Errorf("failed to apply rendered %s, err: %v", environ.StackdriverInstallFilePath, err)
 	}
 
-	fetchFn := c.cluster.NewSinglePodFetch(c.ns.Name(), "app=stackdriver")
-	pods, err := c.cluster.WaitUntilPodsAreReady(fetchFn)
+	fetchFn := cluster.NewSinglePodFetch(ns.Name(), "app=stackdriver")
+	pods, err := cluster.WaitUntilPodsAreReady(fetchFn)
 	if err != nil {
 		return nil, err
 	}
 	pod := pods[0]
 
-	forwarder, err := c.cluster.NewPortForwarder(pod, 0, stackdriverPort)
+	forwarder, err := cluster.NewPortForwarder(pod, 0, stackdriverPort)
 	if err != nil {
 		return nil, err
 	}
@@ -100,21 +137,106 @@ func newKube(ctx resource.Context, cfg Config) (Instance, error) {
 	if err := forwarder.Start(); err != nil {
 		return nil, err
 	}
-	c.forwarder = forwarder
 	scopes.Framework.Debugf("initialized stackdriver port forwarder: %v", forwarder.Address())
 
-	return c, nil
+	return &clusterComponent{ns: ns, forwarder: forwarder, cluster: cluster}, nil
+}
+
+// clusterComponentFor resolves which clusterComponent a call should target: the
+// explicit cluster if one is given, or the sole deployed cluster in single-cluster
+// mode. It returns an error if cluster is nil and Stackdriver was deployed to more
+// than one cluster.
+func (c *kubeComponent) clusterComponentFor(cluster kube.Cluster) (*clusterComponent, error) {
+	if cluster != nil {
+		cc, ok := c.clusters[cluster]
+		if !ok {
+			return nil, fmt.Errorf("stackdriver was not deployed to cluster %v", cluster)
+		}
+		return cc, nil
+	}
+	if len(c.clusters) != 1 {
+		return nil, fmt.Errorf("cluster must be specified: stackdriver was deployed to %d clusters", len(c.clusters))
+	}
+	for _, cc := range c.clusters {
+		return cc, nil
+	}
+	return nil, fmt.Errorf("stackdriver was not deployed to any cluster")
+}
+
+// Filter narrows the time series/log entries returned by the mock Stackdriver
+// server, pushing the filtering down to the server instead of pulling its entire
+// in-memory history on every call. This is only effective once the mock's
+// /timeseries and /logentries endpoints understand the metric_type, resource_type,
+// and label.* query parameters; until then it is silently ignored by the server.
+type Filter struct {
+	MetricType   string
+	ResourceType string
+	Labels       map[string]string
+}
+
+func (f Filter) query() url.Values {
+	q := url.Values{}
+	if f.MetricType != "" {
+		q.Set("metric_type", f.MetricType)
+	}
+	if f.ResourceType != "" {
+		q.Set("resource_type", f.ResourceType)
+	}
+	for k, v := range f.Labels {
+		q.Set("label."+k, v)
+	}
+	return q
+}
+
+func (c *kubeComponent) ListTimeSeries(cluster kube.Cluster) ([]*monitoringpb.TimeSeries, error) {
+	return c.listTimeSeries(cluster, Filter{})
+}
+
+// TimeSeriesFromCluster pairs a TimeSeries with the cluster whose mock Stackdriver
+// returned it, as produced by ListTimeSeriesAll.
+type TimeSeriesFromCluster struct {
+	Cluster    kube.Cluster
+	TimeSeries *monitoringpb.TimeSeries
+}
+
+// ListTimeSeriesAll aggregates ListTimeSeries across every cluster Stackdriver was
+// deployed to, annotating each result with its source cluster. It does not modify
+// the returned TimeSeries themselves, since callers assert on them directly (e.g.
+// on Metric.Labels).
+func (c *kubeComponent) ListTimeSeriesAll() ([]TimeSeriesFromCluster, error) {
+	var ret []TimeSeriesFromCluster
+	for cluster := range c.clusters {
+		ts, err := c.listTimeSeries(cluster, Filter{})
+		if err != nil {
+			return nil, fmt.Errorf("cluster %v: %v", cluster, err)
+		}
+		for _, t := range ts {
+			ret = append(ret, TimeSeriesFromCluster{Cluster: cluster, TimeSeries: t})
+		}
+	}
+	return ret, nil
 }
 
-func (c *kubeComponent) ListTimeSeries() ([]*monitoringpb.TimeSeries, error) {
+func (c *kubeComponent) listTimeSeries(cluster kube.Cluster, f Filter) ([]*monitoringpb.TimeSeries, error) {
+	cc, err := c.clusterComponentFor(cluster)
+	if err != nil {
+		return nil, err
+	}
 	client := http.Client{
 		Timeout: 5 * time.Second,
 	}
-	resp, err := client.Get("http://" + c.forwarder.Address() + "/timeseries")
+	u := "http://" + cc.forwarder.Address() + "/timeseries"
+	if q := f.query(); len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	resp, err := client.Get(u)
 	if err != nil {
 		return []*monitoringpb.TimeSeries{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []*monitoringpb.TimeSeries{}, fmt.Errorf("list time series: unexpected status %s", resp.Status)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return []*monitoringpb.TimeSeries{}, err
@@ -134,15 +256,61 @@ func (c *kubeComponent) ListTimeSeries() ([]*monitoringpb.TimeSeries, error) {
 	return ret, nil
 }
 
-func (c *kubeComponent) ListLogEntries() ([]*loggingpb.LogEntry, error) {
+// WaitForTimeSeries polls ListTimeSeries until matcher accepts at least one result,
+// ctx is cancelled, or the configured timeout elapses.
+func (c *kubeComponent) WaitForTimeSeries(ctx context.Context, cluster kube.Cluster, matcher func(*monitoringpb.TimeSeries) bool,
+	opts ...WaitOption) ([]*monitoringpb.TimeSeries, error) {
+	cfg := newWaitConfig(opts)
+	deadline := time.Now().Add(cfg.timeout)
+	for {
+		ts, err := c.listTimeSeries(cluster, cfg.filter)
+		if err != nil {
+			return nil, err
+		}
+		var matched []*monitoringpb.TimeSeries
+		for _, t := range ts {
+			if matcher(t) {
+				matched = append(matched, t)
+			}
+		}
+		if len(matched) > 0 {
+			return matched, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no matching time series found within %v", cfg.timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(cfg.pollInterval):
+		}
+	}
+}
+
+func (c *kubeComponent) ListLogEntries(cluster kube.Cluster) ([]*loggingpb.LogEntry, error) {
+	return c.listLogEntries(cluster, Filter{})
+}
+
+func (c *kubeComponent) listLogEntries(cluster kube.Cluster, f Filter) ([]*loggingpb.LogEntry, error) {
+	cc, err := c.clusterComponentFor(cluster)
+	if err != nil {
+		return nil, err
+	}
 	client := http.Client{
 		Timeout: 5 * time.Second,
 	}
-	resp, err := client.Get("http://" + c.forwarder.Address() + "/logentries")
+	u := "http://" + cc.forwarder.Address() + "/logentries"
+	if q := f.query(); len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	resp, err := client.Get(u)
 	if err != nil {
 		return []*loggingpb.LogEntry{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []*loggingpb.LogEntry{}, fmt.Errorf("list log entries: unexpected status %s", resp.Status)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return []*loggingpb.LogEntry{}, err
@@ -170,15 +338,235 @@ func (c *kubeComponent) ListLogEntries() ([]*loggingpb.LogEntry, error) {
 	return ret, nil
 }
 
+// WaitForLogEntries polls ListLogEntries until matcher accepts at least one result,
+// ctx is cancelled, or the configured timeout elapses.
+func (c *kubeComponent) WaitForLogEntries(ctx context.Context, cluster kube.Cluster, matcher func(*loggingpb.LogEntry) bool,
+	opts ...WaitOption) ([]*loggingpb.LogEntry, error) {
+	cfg := newWaitConfig(opts)
+	deadline := time.Now().Add(cfg.timeout)
+	for {
+		entries, err := c.listLogEntries(cluster, cfg.filter)
+		if err != nil {
+			return nil, err
+		}
+		var matched []*loggingpb.LogEntry
+		for _, l := range entries {
+			if matcher(l) {
+				matched = append(matched, l)
+			}
+		}
+		if len(matched) > 0 {
+			return matched, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no matching log entries found within %v", cfg.timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(cfg.pollInterval):
+		}
+	}
+}
+
+type waitConfig struct {
+	timeout      time.Duration
+	pollInterval time.Duration
+	filter       Filter
+}
+
+func newWaitConfig(opts []WaitOption) waitConfig {
+	cfg := waitConfig{
+		timeout:      defaultWaitTimeout,
+		pollInterval: defaultWaitPollInterval,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WaitOption configures the polling behavior of WaitForTimeSeries and WaitForLogEntries.
+type WaitOption func(*waitConfig)
+
+// WaitTimeout overrides the default time to wait for a match before giving up.
+func WaitTimeout(d time.Duration) WaitOption {
+	return func(c *waitConfig) { c.timeout = d }
+}
+
+// WaitPollInterval overrides the default delay between polls.
+func WaitPollInterval(d time.Duration) WaitOption {
+	return func(c *waitConfig) { c.pollInterval = d }
+}
+
+// WaitWithFilter pushes the given Filter down to the mock server, instead of
+// pulling its entire in-memory history on every poll.
+func WaitWithFilter(f Filter) WaitOption {
+	return func(c *waitConfig) { c.filter = f }
+}
+
+func (c *kubeComponent) ListTraceSpans(cluster kube.Cluster) ([]*cloudtracepb.Span, error) {
+	cc, err := c.clusterComponentFor(cluster)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Get("http://" + cc.forwarder.Address() + "/traces")
+	if err != nil {
+		return []*cloudtracepb.Span{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []*cloudtracepb.Span{}, fmt.Errorf("list trace spans: unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []*cloudtracepb.Span{}, err
+	}
+	var r cloudtracepb.BatchWriteSpansRequest
+	err = jsonpb.UnmarshalString(string(body), &r)
+	if err != nil {
+		return []*cloudtracepb.Span{}, err
+	}
+	return r.Spans, nil
+}
+
+// State is an opaque snapshot of the mock Stackdriver server's in-memory time
+// series, log entries, and trace spans, keyed by cluster, suitable for passing to
+// Restore.
+type State map[kube.Cluster][]byte
+
+// Reset clears every deployed mock Stackdriver server's accumulated time series,
+// log entries, and trace spans, so that subtests do not have to write "contains"
+// matchers against data left over from earlier subtests.
+func (c *kubeComponent) Reset() error {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	for cluster, cc := range c.clusters {
+		if err := postOK(client, "http://"+cc.forwarder.Address()+"/reset", nil); err != nil {
+			return fmt.Errorf("cluster %v: %v", cluster, err)
+		}
+	}
+	return nil
+}
+
+// postOK issues a POST to url and returns an error unless the response status is 200.
+func postOK(client http.Client, url string, body io.Reader) error {
+	resp, err := client.Post(url, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Snapshot captures every deployed mock Stackdriver server's current state, to be
+// restored later via Restore.
+func (c *kubeComponent) Snapshot() (State, error) {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	state := State{}
+	for cluster, cc := range c.clusters {
+		resp, err := client.Get("http://" + cc.forwarder.Address() + "/snapshot")
+		if err != nil {
+			return nil, fmt.Errorf("cluster %v: %v", cluster, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("cluster %v: snapshot stackdriver mock: unexpected status %s", cluster, resp.Status)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cluster %v: %v", cluster, err)
+		}
+		state[cluster] = body
+	}
+	return state, nil
+}
+
+// Restore replaces every deployed mock Stackdriver server's state with a State
+// previously captured by Snapshot.
+func (c *kubeComponent) Restore(s State) error {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+	}
+	for cluster, cc := range c.clusters {
+		body, ok := s[cluster]
+		if !ok {
+			return fmt.Errorf("no snapshot for cluster %v", cluster)
+		}
+		if err := postOK(client, "http://"+cc.forwarder.Address()+"/restore", bytes.NewReader(body)); err != nil {
+			return fmt.Errorf("cluster %v: %v", cluster, err)
+		}
+	}
+	return nil
+}
+
 func (c *kubeComponent) ID() resource.ID {
 	return c.id
 }
 
 // Close implements io.Closer.
 func (c *kubeComponent) Close() error {
+	c.dumpLogs()
 	return nil
 }
 
-func (c *kubeComponent) GetStackdriverNamespace() string {
-	return c.ns.Name()
+// dumpLogs persists the stdout/stderr of every container in each cluster's
+// Stackdriver pod (including the envoy sidecar, if injected) to the test's work
+// directory, so that an unexpected ListTimeSeries/ListLogEntries result can be
+// debugged after the fact.
+func (c *kubeComponent) dumpLogs() {
+	c.dumpOnce.Do(func() {
+		if len(c.clusters) == 0 {
+			// Stackdriver was never (fully) deployed, e.g. newKube failed before any
+			// cluster was brought up; there is nothing to dump.
+			return
+		}
+
+		dir := filepath.Join(c.ctx.WorkDir(), "stackdriver")
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			scopes.Framework.Warnf("unable to create stackdriver log directory %s: %v", dir, err)
+			return
+		}
+
+		for _, cc := range c.clusters {
+			pods, err := cc.cluster.PodsForSelector(cc.ns.Name(), "app=stackdriver")
+			if err != nil {
+				scopes.Framework.Warnf("unable to list stackdriver pods for log dump: %v", err)
+				continue
+			}
+
+			for _, pod := range pods.Items {
+				for _, container := range pod.Spec.Containers {
+					logs, err := cc.cluster.PodLogs(context.TODO(), pod.Namespace, pod.Name, container.Name, false)
+					if err != nil {
+						scopes.Framework.Warnf("unable to get logs for %s/%s: %v", pod.Name, container.Name, err)
+						continue
+					}
+					fname := filepath.Join(dir, fmt.Sprintf("%s-%s.log", pod.Name, container.Name))
+					if err := ioutil.WriteFile(fname, []byte(logs), os.ModePerm); err != nil {
+						scopes.Framework.Warnf("unable to write stackdriver log %s: %v", fname, err)
+					}
+				}
+			}
+		}
+	})
+}
+
+func (c *kubeComponent) GetStackdriverNamespace(cluster kube.Cluster) string {
+	cc, err := c.clusterComponentFor(cluster)
+	if err != nil {
+		scopes.Framework.Warnf("unable to resolve stackdriver namespace: %v", err)
+		return ""
+	}
+	return cc.ns.Name()
 }